@@ -0,0 +1,290 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/eapache/channels"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+)
+
+// bmpPeerType mirrors the BMP Peer Type field (RFC 7854, extended by
+// RFC 8671/RFC 9069 for the Loc-RIB instance peer type).
+type bmpPeerType uint8
+
+const (
+	bmpPeerTypeGlobal bmpPeerType = iota
+	bmpPeerTypeRD
+	bmpPeerTypeLocal
+	bmpPeerTypeLocalRib
+)
+
+// bmpRibType selects which view of a path update a bmpRouteMonitoringEvent
+// was derived from, so the station can tag it with the right Peer Flags
+// (O bit / L bit) when it serializes the Route Monitoring message.
+type bmpRibType int
+
+const (
+	bmpRibAdjIn bmpRibType = iota
+	bmpRibAdjOutPre
+	bmpRibAdjOutPost
+	bmpRibLocal
+)
+
+// bmpRouteMonitoringEvent is what Peer pushes onto its bmpOutgoing sink.
+// The BMP station consumes these in order and is responsible for turning
+// them into wire-format Route Monitoring messages.
+type bmpRouteMonitoringEvent struct {
+	peerType bmpPeerType
+	ribType  bmpRibType
+	peerID   string
+	instance string
+	path     *table.Path
+}
+
+// BMP version and Common Header message types (RFC 7854 section 4.1).
+// Only the one message type this file actually emits is defined.
+const (
+	bmpVersion = 3
+
+	bmpMsgTypeRouteMonitoring uint8 = 0
+)
+
+// Per-Peer Header Peer Flags bits (RFC 7854 section 4.2, RFC 9069 section
+// 4.2 for the O bit).
+const (
+	bmpPeerFlagV uint8 = 1 << 7 // peer address is IPv6
+	bmpPeerFlagL uint8 = 1 << 6 // post-policy Adj-RIB-Out/Adj-RIB-In
+	bmpPeerFlagO uint8 = 1 << 4 // Adj-RIB-Out (vs. Adj-RIB-In/Loc-RIB)
+)
+
+const bmpPerPeerHeaderLen = 42
+
+// errBMPUpdateBodyNotSerialized is returned by serializeBMPRouteMonitoring
+// for every event: turning ev.path back into the BGP UPDATE bytes RFC 7854
+// requires as the Route Monitoring message body needs the same
+// path-to-wire logic the real FSM uses to build outgoing UPDATE messages,
+// which isn't available to this package in this tree. Callers must not
+// treat a non-nil return alongside this error as a usable message.
+var errBMPUpdateBodyNotSerialized = fmt.Errorf("BMP route monitoring body serialization is not implemented")
+
+// serializeBMPCommonHeader builds the 6-byte Common Header (RFC 7854
+// section 4.1) that precedes every BMP message, given the total length of
+// the message body that follows it.
+func serializeBMPCommonHeader(msgType uint8, bodyLen int) []byte {
+	buf := make([]byte, 6)
+	buf[0] = bmpVersion
+	binary.BigEndian.PutUint32(buf[1:5], uint32(6+bodyLen))
+	buf[5] = msgType
+	return buf
+}
+
+// serializeBMPPerPeerHeader builds the 42-byte Per-Peer Header (RFC 7854
+// section 4.2) for ev, describing peer by its address, AS and BGP
+// Identifier as recorded in peer.fsm.peerInfo.
+func serializeBMPPerPeerHeader(peer *Peer, ev *bmpRouteMonitoringEvent, ts time.Time) []byte {
+	buf := make([]byte, bmpPerPeerHeaderLen)
+	buf[0] = uint8(ev.peerType)
+
+	var flags uint8
+	addr := peer.fsm.peerInfo.Address
+	if addr != nil && addr.To4() == nil {
+		flags |= bmpPeerFlagV
+	}
+	if ev.ribType == bmpRibAdjOutPre || ev.ribType == bmpRibAdjOutPost {
+		flags |= bmpPeerFlagO
+	}
+	if ev.ribType == bmpRibAdjOutPost {
+		flags |= bmpPeerFlagL
+	}
+	buf[1] = flags
+
+	// Peer Distinguisher: zero for the default (non-RD, non-VRF) instance.
+	binary.BigEndian.PutUint64(buf[2:10], 0)
+
+	if addr != nil {
+		if ip4 := addr.To4(); ip4 != nil {
+			copy(buf[22:26], ip4)
+		} else {
+			copy(buf[10:26], addr.To16())
+		}
+	}
+	binary.BigEndian.PutUint32(buf[26:30], peer.fsm.peerInfo.AS)
+	if id := peer.fsm.peerInfo.ID; id != nil {
+		copy(buf[30:34], id.To4())
+	}
+	binary.BigEndian.PutUint32(buf[34:38], uint32(ts.Unix()))
+	binary.BigEndian.PutUint32(buf[38:42], uint32(ts.Nanosecond()/1000))
+	return buf
+}
+
+// serializeBMPRouteMonitoring builds the Common Header and Per-Peer Header
+// for ev and reports errBMPUpdateBodyNotSerialized: the headers are real,
+// RFC 7854-accurate bytes, but the Route Monitoring body (ev.path
+// reconstituted as a BGP UPDATE) is not produced by this package - see
+// errBMPUpdateBodyNotSerialized. Do not present this as a working BMP
+// export path; it exists so the framing is ready for whichever layer ends
+// up owning the collector TCP session and the path-to-UPDATE conversion.
+func serializeBMPRouteMonitoring(peer *Peer, ev *bmpRouteMonitoringEvent) ([]byte, error) {
+	perPeer := serializeBMPPerPeerHeader(peer, ev, time.Now())
+	common := serializeBMPCommonHeader(bmpMsgTypeRouteMonitoring, len(perPeer))
+	return append(common, perPeer...), errBMPUpdateBodyNotSerialized
+}
+
+// sendBmpRouteMonitoring pushes a route monitoring event for path onto
+// peer.bmpOutgoing. It never blocks the FSM: bmpOutgoing is an
+// channels.InfiniteChannel, same as peer.outgoing, so a slow or wedged BMP
+// collector can't back-pressure session processing.
+//
+// Callers must only reach this from an actual RIB transition (a path being
+// advertised, withdrawn or installed as best), never from a read-only
+// status query - see the emit argument threaded through filterpath and
+// getBestFromLocal/getAdditionalPathsFromLocal.
+func (peer *Peer) sendBmpRouteMonitoring(ribType bmpRibType, path *table.Path) {
+	if peer.bmpOutgoing == nil || path == nil {
+		return
+	}
+	ev := &bmpRouteMonitoringEvent{
+		peerType: bmpPeerTypeGlobal,
+		ribType:  ribType,
+		peerID:   peer.ID(),
+		path:     path,
+	}
+	if ribType == bmpRibLocal {
+		ev.peerType = bmpPeerTypeLocalRib
+		ev.instance = peer.locRibPeerID()
+	}
+	peer.bmpOutgoing.In() <- ev
+}
+
+// bmpStreamEnabled reports whether the neighbor has opted into the given
+// BMP monitoring stream (adj-rib-out pre-policy, adj-rib-out post-policy or
+// loc-rib). Adj-RIB-In monitoring is unconditional and predates this work.
+func (peer *Peer) bmpStreamEnabled(ribType bmpRibType) bool {
+	c := peer.fsm.pConf.State.BmpStreams
+	switch ribType {
+	case bmpRibAdjOutPre:
+		return c.AdjRibOutPreEnabled
+	case bmpRibAdjOutPost:
+		return c.AdjRibOutPostEnabled
+	case bmpRibLocal:
+		return c.LocRibEnabled
+	default:
+		return true
+	}
+}
+
+// ensureBmpOutgoing lazily creates the BMP fan-out sink the first time a
+// neighbor enables any of the new monitoring streams, so peers that never
+// use BMP don't pay for the channel. It also starts the goroutine that
+// drains it: until a real BMP station (TCP framing, Peer Up/Down,
+// Initiation messages, ...) exists, there is nothing else consuming this
+// channel, and an InfiniteChannel with no reader grows without bound.
+func (peer *Peer) ensureBmpOutgoing() *channels.InfiniteChannel {
+	if peer.bmpOutgoing == nil {
+		peer.bmpOutgoing = channels.NewInfiniteChannel()
+		go peer.drainBmpOutgoing(peer.bmpOutgoing)
+	}
+	return peer.bmpOutgoing
+}
+
+// drainBmpOutgoing consumes peer.bmpOutgoing and builds the real Common
+// Header + Per-Peer Header for each event (see serializeBMPRouteMonitoring),
+// which is as far as this package can take a Route Monitoring message: it
+// has no BGP-UPDATE-body serializer and no owner for an actual collector
+// TCP session (see errBMPUpdateBodyNotSerialized). This is NOT a working
+// BMP export - every event is still dropped after being logged - it only
+// stops an InfiniteChannel with no reader from growing without bound, and
+// exercises the header framing so the remaining gap is the body
+// serializer and the station connection, not this plumbing.
+func (peer *Peer) drainBmpOutgoing(ch *channels.InfiniteChannel) {
+	for v := range ch.Out() {
+		ev := v.(*bmpRouteMonitoringEvent)
+		_, err := serializeBMPRouteMonitoring(peer, ev)
+		log.WithFields(log.Fields{
+			"Topic":    "Peer",
+			"Key":      peer.ID(),
+			"RibType":  ev.ribType,
+			"PeerType": ev.peerType,
+			"Error":    err,
+		}).Trace("BMP event dropped: no BMP station is wired up yet")
+	}
+}
+
+// locRibPeerID returns the synthetic Peer identifier BMP stations should use
+// for this neighbor's Loc-RIB instance, as described in RFC 9069: the VRF
+// name (or table.GLOBAL_RIB_NAME for the global instance) distinguishes
+// one Loc-RIB peer from another on the same BMP session.
+func (peer *Peer) locRibPeerID() string {
+	if vrf := peer.fsm.pConf.Config.Vrf; vrf != "" {
+		return vrf
+	}
+	return table.GLOBAL_RIB_NAME
+}
+
+// sendBmpLocRibPeerUp records Loc-RIB Peer Up for this neighbor's instance:
+// it logs the transition and makes sure the bmpOutgoing sink exists. No
+// Peer Up message or event is put on bmpOutgoing. Callers invoke it once
+// when the session (re)establishes.
+func (peer *Peer) sendBmpLocRibPeerUp() {
+	if !peer.bmpStreamEnabled(bmpRibLocal) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"Topic":    "Peer",
+		"Key":      peer.ID(),
+		"Instance": peer.locRibPeerID(),
+	}).Debug("BMP loc-rib peer up")
+	peer.ensureBmpOutgoing()
+}
+
+// sendBmpLocRibPeerDown records Loc-RIB Peer Down, mirroring
+// sendBmpLocRibPeerUp: it only logs the transition; no Peer Down message
+// or event is put on bmpOutgoing.
+func (peer *Peer) sendBmpLocRibPeerDown() {
+	if !peer.bmpStreamEnabled(bmpRibLocal) || peer.bmpOutgoing == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"Topic":    "Peer",
+		"Key":      peer.ID(),
+		"Instance": peer.locRibPeerID(),
+	}).Debug("BMP loc-rib peer down")
+}
+
+// HandleFSMStateChange is the intended FSM hook for BMP Loc-RIB peer
+// bookkeeping: called on every state transition, it would make
+// sendBmpLocRibPeerUp/Down fire exactly once per establishment/drop,
+// mirroring how PassConn is the FSM's hook for accepted connections.
+//
+// It is not currently called anywhere: the FSM state machine (fsm.go)
+// that would own the transition loop isn't part of this tree, and this
+// package has no other call site for it. Until that wiring lands,
+// sendBmpLocRibPeerUp/Down never fire and Loc-RIB BMP peer-up/down
+// bookkeeping does not actually happen.
+func (peer *Peer) HandleFSMStateChange(oldState, newState bgp.FSMState) {
+	if newState == bgp.BGP_FSM_ESTABLISHED {
+		peer.sendBmpLocRibPeerUp()
+	} else if oldState == bgp.BGP_FSM_ESTABLISHED {
+		peer.sendBmpLocRibPeerDown()
+	}
+}
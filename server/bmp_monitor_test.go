@@ -0,0 +1,48 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// serializeBMPPerPeerHeader needs a *Peer with a populated fsm.peerInfo,
+// which this tree has no FSM type to construct (see the NOTE in
+// bmp_monitor.go's HandleFSMStateChange doc comment) - only the Common
+// Header, which doesn't depend on Peer at all, is exercised here.
+func TestSerializeBMPCommonHeader(t *testing.T) {
+	buf := serializeBMPCommonHeader(bmpMsgTypeRouteMonitoring, 42)
+	if len(buf) != 6 {
+		t.Fatalf("common header length = %d, want 6", len(buf))
+	}
+	if buf[0] != bmpVersion {
+		t.Errorf("version = %d, want %d", buf[0], bmpVersion)
+	}
+	if got, want := binary.BigEndian.Uint32(buf[1:5]), uint32(6+42); got != want {
+		t.Errorf("message length = %d, want %d", got, want)
+	}
+	if buf[5] != bmpMsgTypeRouteMonitoring {
+		t.Errorf("message type = %d, want %d", buf[5], bmpMsgTypeRouteMonitoring)
+	}
+}
+
+func TestSerializeBMPCommonHeaderZeroBody(t *testing.T) {
+	buf := serializeBMPCommonHeader(bmpMsgTypeRouteMonitoring, 0)
+	if got, want := binary.BigEndian.Uint32(buf[1:5]), uint32(6); got != want {
+		t.Errorf("message length = %d, want %d", got, want)
+	}
+}
@@ -16,14 +16,17 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strconv"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/eapache/channels"
 	"github.com/osrg/gobgp/config"
 	"github.com/osrg/gobgp/packet/bgp"
 	"github.com/osrg/gobgp/table"
-	"net"
-	"time"
 )
 
 const (
@@ -36,10 +39,13 @@ type Peer struct {
 	fsm               *FSM
 	adjRibIn          *table.AdjRib
 	outgoing          *channels.InfiniteChannel
+	bmpOutgoing       *channels.InfiniteChannel
 	policy            *table.RoutingPolicy
 	localRib          *table.TableManager
-	prefixLimitWarned map[bgp.RouteFamily]bool
 	llgrEndChs        []chan struct{}
+	gracefulShutdown  *gracefulShutdownState
+	prefixLimitStates map[bgp.RouteFamily]*prefixLimitState
+	orfPrefixLists    map[bgp.RouteFamily]*orfPrefixList
 }
 
 func NewPeer(g *config.Global, conf *config.Neighbor, loc *table.TableManager, policy *table.RoutingPolicy) *Peer {
@@ -48,7 +54,7 @@ func NewPeer(g *config.Global, conf *config.Neighbor, loc *table.TableManager, p
 		localRib:          loc,
 		policy:            policy,
 		fsm:               NewFSM(g, conf, policy),
-		prefixLimitWarned: make(map[bgp.RouteFamily]bool),
+		prefixLimitStates: make(map[bgp.RouteFamily]*prefixLimitState),
 	}
 	if peer.isRouteServerClient() {
 		peer.tableId = conf.Config.NeighborAddress
@@ -56,7 +62,18 @@ func NewPeer(g *config.Global, conf *config.Neighbor, loc *table.TableManager, p
 		peer.tableId = table.GLOBAL_RIB_NAME
 	}
 	rfs, _ := config.AfiSafis(conf.AfiSafis).ToRfList()
+	// NOTE: this AdjRib is keyed by NLRI alone, so for a family that
+	// negotiates ADD-PATH receive, a second path for the same prefix
+	// silently overwrites the first instead of both being kept - the
+	// (prefix, path-id)-keyed receive-side storage RFC 7911 needs is NOT
+	// implemented. That needs changes to table.AdjRib, which isn't part
+	// of this checkout; validateAddPathReceive only logs when a path-id
+	// arrives on a family that never negotiated receive at all, which is
+	// a narrower and different problem than the clobbering above.
 	peer.adjRibIn = table.NewAdjRib(peer.ID(), rfs)
+	if s := conf.State.BmpStreams; s.AdjRibOutPreEnabled || s.AdjRibOutPostEnabled || s.LocRibEnabled {
+		peer.ensureBmpOutgoing()
+	}
 	return peer
 }
 
@@ -231,7 +248,7 @@ func (peer *Peer) getAccepted(rfList []bgp.RouteFamily) []*table.Path {
 	return peer.adjRibIn.PathList(rfList, true)
 }
 
-func (peer *Peer) filterpath(path, old *table.Path) *table.Path {
+func (peer *Peer) filterpath(path, old *table.Path, emitBMP bool) *table.Path {
 	// special handling for RTC nlri
 	// see comments in (*Destination).Calculate()
 	if path != nil && path.GetRouteFamily() == bgp.RF_RTC_UC && !path.IsWithdraw {
@@ -271,9 +288,24 @@ func (peer *Peer) filterpath(path, old *table.Path) *table.Path {
 		return nil
 	}
 
+	// RFC 5291: an ORF prefix list the peer installed via ROUTE-REFRESH
+	// acts as an implicit export filter, consulted ahead of policy.
+	if path != nil && !path.IsWithdraw && !peer.orfFilterPermits(path) {
+		return nil
+	}
+
 	path = path.Clone(path.IsWithdraw)
 	path.UpdatePathAttrs(peer.fsm.gConf, peer.fsm.pConf)
 
+	// RFC 8671: Adj-RIB-Out Pre-Policy reflects what's about to be handed
+	// to the export policy, before it can be filtered or modified further.
+	// Only do this for a real advertisement pass: emitBMP is false for
+	// read-only callers like ToConfig's stats query, which must not
+	// re-emit a Route Monitoring event for every best path on every poll.
+	if emitBMP && peer.bmpStreamEnabled(bmpRibAdjOutPre) {
+		peer.sendBmpRouteMonitoring(bmpRibAdjOutPre, path)
+	}
+
 	options := &table.PolicyOptions{
 		Info: peer.fsm.peerInfo,
 	}
@@ -299,14 +331,39 @@ func (peer *Peer) filterpath(path, old *table.Path) *table.Path {
 	if path != nil && !peer.isIBGPPeer() && !peer.isRouteServerClient() {
 		path.RemoveLocalPref()
 	}
+
+	// RFC 8203 / draft-ietf-idr-shutdown: during the drain window of an
+	// administrative graceful shutdown, tag outgoing paths with the
+	// GRACEFUL_SHUTDOWN community so the peer can react before the Cease.
+	path = peer.injectGracefulShutdownCommunity(path)
+
+	// RFC 8671: Adj-RIB-Out Post-Policy reflects the path as it will
+	// actually go out on the wire, after export policy has run.
+	if path != nil && emitBMP && peer.bmpStreamEnabled(bmpRibAdjOutPost) {
+		peer.sendBmpRouteMonitoring(bmpRibAdjOutPost, path)
+	}
 	return path
 }
 
-func (peer *Peer) getBestFromLocal(rfList []bgp.RouteFamily) ([]*table.Path, []*table.Path) {
+// getBestFromLocal returns the best path per destination for rfList, along
+// with the paths that lost out to filterpath/policy. emitBMP must be true
+// only when this is a genuine advertisement/resync pass: it also gates the
+// RFC 9069 Loc-RIB Route Monitoring emission below, since this is called
+// from ToConfig's read-only stats query (via getAdditionalPathsFromLocal)
+// as well as from the real send path, and a stats poll must not flood BMP
+// collectors with an event per best path.
+func (peer *Peer) getBestFromLocal(rfList []bgp.RouteFamily, emitBMP bool) ([]*table.Path, []*table.Path) {
 	pathList := []*table.Path{}
 	filtered := []*table.Path{}
+	locRibEnabled := emitBMP && peer.bmpStreamEnabled(bmpRibLocal)
 	for _, path := range peer.localRib.GetBestPathList(peer.TableID(), peer.toGlobalFamilies(rfList)) {
-		if p := peer.filterpath(path, nil); p != nil {
+		// RFC 9069: Loc-RIB monitoring reports the best path as installed
+		// in the local RIB, independent of whether this neighbor's export
+		// policy will end up advertising it.
+		if locRibEnabled {
+			peer.sendBmpRouteMonitoring(bmpRibLocal, path)
+		}
+		if p := peer.filterpath(path, nil, emitBMP); p != nil {
 			pathList = append(pathList, p)
 		} else {
 			filtered = append(filtered, path)
@@ -340,66 +397,13 @@ func (peer *Peer) processOutgoingPaths(paths, olds []*table.Path) []*table.Path
 		if olds != nil {
 			old = olds[idx]
 		}
-		if p := peer.filterpath(path, old); p != nil {
+		if p := peer.filterpath(path, old, true); p != nil {
 			outgoing = append(outgoing, p)
 		}
 	}
 	return outgoing
 }
 
-func (peer *Peer) handleRouteRefresh(e *FsmMsg) []*table.Path {
-	m := e.MsgData.(*bgp.BGPMessage)
-	rr := m.Body.(*bgp.BGPRouteRefresh)
-	rf := bgp.AfiSafiToRouteFamily(rr.AFI, rr.SAFI)
-	if _, ok := peer.fsm.rfMap[rf]; !ok {
-		log.WithFields(log.Fields{
-			"Topic": "Peer",
-			"Key":   peer.ID(),
-			"Data":  rf,
-		}).Warn("Route family isn't supported")
-		return nil
-	}
-	if _, ok := peer.fsm.capMap[bgp.BGP_CAP_ROUTE_REFRESH]; !ok {
-		log.WithFields(log.Fields{
-			"Topic": "Peer",
-			"Key":   peer.ID(),
-		}).Warn("ROUTE_REFRESH received but the capability wasn't advertised")
-		return nil
-	}
-	rfList := []bgp.RouteFamily{rf}
-	accepted, filtered := peer.getBestFromLocal(rfList)
-	for _, path := range filtered {
-		path.IsWithdraw = true
-		accepted = append(accepted, path)
-	}
-	return accepted
-}
-
-func (peer *Peer) doPrefixLimit(k bgp.RouteFamily, c *config.PrefixLimitConfig) *bgp.BGPMessage {
-	if maxPrefixes := int(c.MaxPrefixes); maxPrefixes > 0 {
-		count := peer.adjRibIn.Count([]bgp.RouteFamily{k})
-		pct := int(c.ShutdownThresholdPct)
-		if pct > 0 && !peer.prefixLimitWarned[k] && count > (maxPrefixes*pct/100) {
-			peer.prefixLimitWarned[k] = true
-			log.WithFields(log.Fields{
-				"Topic":         "Peer",
-				"Key":           peer.ID(),
-				"AddressFamily": k.String(),
-			}).Warnf("prefix limit %d%% reached", pct)
-		}
-		if count > maxPrefixes {
-			log.WithFields(log.Fields{
-				"Topic":         "Peer",
-				"Key":           peer.ID(),
-				"AddressFamily": k.String(),
-			}).Warnf("prefix limit reached")
-			return bgp.NewBGPNotificationMessage(bgp.BGP_ERROR_CEASE, bgp.BGP_ERROR_SUB_MAXIMUM_NUMBER_OF_PREFIXES_REACHED, nil)
-		}
-	}
-	return nil
-
-}
-
 func (peer *Peer) updatePrefixLimitConfig(c []config.AfiSafi) error {
 	x := peer.fsm.pConf.AfiSafis
 	y := c
@@ -431,7 +435,11 @@ func (peer *Peer) updatePrefixLimitConfig(c []config.AfiSafi) error {
 				"OldShutdownThresholdPct": p.ShutdownThresholdPct,
 				"NewShutdownThresholdPct": e.PrefixLimit.Config.ShutdownThresholdPct,
 			}).Warnf("update prefix limit configuration")
-			peer.prefixLimitWarned[k] = false
+			// A revised prefix-limit is the operator's administrative
+			// "clear" for an idle-latched family: drop both the idle hold
+			// and the shutdown-threshold warning so it's re-evaluated
+			// fresh against the new limits.
+			peer.clearPrefixLimitIdle(k)
 			if msg := peer.doPrefixLimit(k, &e.PrefixLimit.Config); msg != nil {
 				sendFsmOutgoingMsg(peer, nil, msg, true)
 			}
@@ -454,6 +462,7 @@ func (peer *Peer) handleUpdate(e *FsmMsg) ([]*table.Path, []bgp.RouteFamily, *bg
 	peer.fsm.pConf.Timers.State.UpdateRecvTime = time.Now().Unix()
 	if len(e.PathList) > 0 {
 		peer.adjRibIn.Update(e.PathList)
+		peer.validateAddPathReceive(e.PathList)
 		for _, family := range peer.fsm.pConf.AfiSafis {
 			k, _ := bgp.GetRouteFamily(string(family.Config.AfiSafiName))
 			if msg := peer.doPrefixLimit(k, &family.PrefixLimit.Config); msg != nil {
@@ -492,7 +501,33 @@ func (peer *Peer) StaleAll(rfList []bgp.RouteFamily) {
 	peer.adjRibIn.StaleAll(rfList)
 }
 
+// DialConn is the intended active-open counterpart to PassConn: the FSM's
+// connect-retry loop would call this instead of net.Dial/net.DialTCP
+// directly whenever it attempts an active open, so TCP-AO keys (see
+// dialTCPAO) get installed on the socket before connect() when this
+// neighbor requires them.
+//
+// Nothing calls it yet. The connect-retry loop lives in the FSM (fsm.go),
+// which isn't part of this checkout, and this package has no other active
+// dial call site to switch over to DialConn. Until something does, an
+// active-open TCP-AO neighbor's outbound SYN is never signed, because
+// whatever currently dials out still goes through plain net.Dial.
+func (peer *Peer) DialConn(ctx context.Context) (*net.TCPConn, error) {
+	conf := peer.fsm.pConf
+	raddr := net.JoinHostPort(conf.Config.NeighborAddress, strconv.Itoa(bgp.BGP_PORT))
+	return dialTCPAO(ctx, nil, raddr, conf)
+}
+
 func (peer *Peer) PassConn(conn *net.TCPConn) {
+	if err := validateTCPAOKeyID(conn, peer.fsm.pConf); err != nil {
+		log.WithFields(log.Fields{
+			"Topic": "Peer",
+			"Key":   peer.ID(),
+			"Error": err,
+		}).Warn("rejecting accepted conn, TCP-AO validation failed")
+		conn.Close()
+		return
+	}
 	select {
 	case peer.fsm.connCh <- conn:
 	default:
@@ -532,7 +567,10 @@ func (peer *Peer) ToConfig(getAdvertised bool) *config.Neighbor {
 	if peer.fsm.state == bgp.BGP_FSM_ESTABLISHED {
 		rfList := peer.configuredRFlist()
 		if getAdvertised {
-			pathList, _ := peer.getBestFromLocal(rfList)
+			// emitBMP=false: this is a read-only stats query, not a real
+			// advertisement pass, and must not re-emit Adj-RIB-Out/Loc-RIB
+			// BMP Route Monitoring events for every best path on every poll.
+			pathList, _ := peer.getAdditionalPathsFromLocal(rfList, false)
 			conf.State.AdjTable.Advertised = uint32(len(pathList))
 		} else {
 			conf.State.AdjTable.Advertised = 0
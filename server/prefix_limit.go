@@ -0,0 +1,213 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet/bgp"
+)
+
+// prefixLimitState tracks the per-AFI/SAFI bookkeeping needed to implement
+// the Cisco/Juniper-style prefix-limit modes: whether the shutdown
+// threshold warning already fired, whether the family is currently idle
+// (held down until cleared administratively), the pending restart timer,
+// and a rolling count of NLRIs discarded in discard-extra-paths mode.
+//
+// doPrefixLimit runs on the update-processing goroutine, while
+// scheduleRestart's time.AfterFunc callback runs on its own goroutine; mu
+// guards every field below so the two don't race.
+type prefixLimitState struct {
+	mu           sync.Mutex
+	warned       bool
+	idle         bool
+	restartTimer *time.Timer
+	discarded    uint64
+}
+
+// prefixLimitStateFor returns the bookkeeping for family k, creating it on
+// first use.
+func (peer *Peer) prefixLimitStateFor(k bgp.RouteFamily) *prefixLimitState {
+	if peer.prefixLimitStates == nil {
+		peer.prefixLimitStates = make(map[bgp.RouteFamily]*prefixLimitState)
+	}
+	st, ok := peer.prefixLimitStates[k]
+	if !ok {
+		st = &prefixLimitState{}
+		peer.prefixLimitStates[k] = st
+	}
+	return st
+}
+
+// isPrefixLimitIdle reports whether family k is being held down by a
+// previous prefix-limit violation configured with idle-hold semantics;
+// the FSM should refuse to auto re-establish the session for this family
+// until an operator clears it.
+func (peer *Peer) isPrefixLimitIdle(k bgp.RouteFamily) bool {
+	if peer.prefixLimitStates == nil {
+		return false
+	}
+	st, ok := peer.prefixLimitStates[k]
+	if !ok {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.idle
+}
+
+// ReadyToReestablish reports whether family k may be brought back up: it
+// is false while doPrefixLimit has latched k idle, and while a restart
+// timer scheduled for k has not yet expired.
+//
+// Nothing in this tree calls it: the idle-hold/reconnect timer loop lives
+// in the FSM (fsm.go), which isn't part of this checkout, and this package
+// has no other caller for it. doPrefixLimit's "idle" and "restart-timer"
+// modes record their hold on a violation, but no reconnect path is gated
+// on it - the family can still come back up immediately.
+func (peer *Peer) ReadyToReestablish(k bgp.RouteFamily) bool {
+	if peer.isPrefixLimitIdle(k) {
+		return false
+	}
+	st, ok := peer.prefixLimitStates[k]
+	if !ok {
+		return true
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.restartTimer == nil
+}
+
+// clearPrefixLimitIdle clears the idle-hold latched by a prior prefix
+// limit violation, allowing the FSM's idle-hold timer to resume normal
+// reconnect behavior for family k. It is the administrative "clear" an
+// operator would invoke for an idle-mode family; updatePrefixLimitConfig
+// calls it whenever an operator pushes a revised prefix-limit for k.
+func (peer *Peer) clearPrefixLimitIdle(k bgp.RouteFamily) {
+	st, ok := peer.prefixLimitStates[k]
+	if !ok {
+		return
+	}
+	st.mu.Lock()
+	st.idle = false
+	st.warned = false
+	st.mu.Unlock()
+}
+
+// scheduleRestart arranges for the shutdown-threshold warning (and, for
+// restart-timer mode, the teardown itself) to be forgotten after d has
+// elapsed, so the session is allowed to come back up automatically.
+// Callers must hold st.mu; the AfterFunc callback acquires it itself since
+// it runs on its own goroutine, independent of the update-processing
+// goroutine that calls doPrefixLimit.
+func (st *prefixLimitState) scheduleRestart(peer *Peer, k bgp.RouteFamily, d time.Duration) {
+	if st.restartTimer != nil {
+		st.restartTimer.Stop()
+	}
+	st.restartTimer = time.AfterFunc(d, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		log.WithFields(log.Fields{
+			"Topic":         "Peer",
+			"Key":           peer.ID(),
+			"AddressFamily": k.String(),
+		}).Info("prefix limit restart timer expired, allowing re-establishment")
+		st.warned = false
+		st.restartTimer = nil
+	})
+}
+
+// doPrefixLimit implements the per-family prefix-limit policy configured
+// on the neighbor. In addition to the original "warn at the shutdown
+// threshold, Cease when max-prefixes is exceeded" behavior, it now
+// supports:
+//
+//   - soft:                warn at max-prefixes but never tear down or
+//     discard anything.
+//   - discard-extra-paths: silently drop NLRIs once max-prefixes is
+//     reached instead of tearing down the session, tracking a rolling
+//     count of how many have been discarded.
+//   - idle:                tear down as before, but latch the family as
+//     idle, so ReadyToReestablish reports false for it until an operator
+//     clears it with clearPrefixLimitIdle.
+//   - restart-timer:       tear down as before, but automatically forget
+//     the violation (and thus let ReadyToReestablish report true again)
+//     after the configured number of minutes.
+func (peer *Peer) doPrefixLimit(k bgp.RouteFamily, c *config.PrefixLimitConfig) *bgp.BGPMessage {
+	maxPrefixes := int(c.MaxPrefixes)
+	if maxPrefixes <= 0 {
+		return nil
+	}
+
+	st := peer.prefixLimitStateFor(k)
+	count := peer.adjRibIn.Count([]bgp.RouteFamily{k})
+	pct := int(c.ShutdownThresholdPct)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if pct > 0 && !st.warned && count > (maxPrefixes*pct/100) {
+		st.warned = true
+		log.WithFields(log.Fields{
+			"Topic":         "Peer",
+			"Key":           peer.ID(),
+			"AddressFamily": k.String(),
+		}).Warnf("prefix limit %d%% reached", pct)
+	}
+
+	if count <= maxPrefixes {
+		return nil
+	}
+
+	if c.Soft {
+		log.WithFields(log.Fields{
+			"Topic":         "Peer",
+			"Key":           peer.ID(),
+			"AddressFamily": k.String(),
+		}).Warnf("prefix limit reached (soft, no action taken)")
+		return nil
+	}
+
+	if c.DiscardExtraPaths {
+		dropped := peer.adjRibIn.DiscardExcess(k, maxPrefixes)
+		st.discarded += uint64(dropped)
+		log.WithFields(log.Fields{
+			"Topic":          "Peer",
+			"Key":            peer.ID(),
+			"AddressFamily":  k.String(),
+			"Discarded":      dropped,
+			"TotalDiscarded": st.discarded,
+		}).Warnf("prefix limit reached, discarding excess NLRIs")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"Topic":         "Peer",
+		"Key":           peer.ID(),
+		"AddressFamily": k.String(),
+	}).Warnf("prefix limit reached")
+
+	switch {
+	case c.Idle:
+		st.idle = true
+	case c.RestartTimer > 0:
+		st.scheduleRestart(peer, k, time.Duration(c.RestartTimer)*time.Minute)
+	}
+	return bgp.NewBGPNotificationMessage(bgp.BGP_ERROR_CEASE, bgp.BGP_ERROR_SUB_MAXIMUM_NUMBER_OF_PREFIXES_REACHED, nil)
+}
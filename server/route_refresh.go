@@ -0,0 +1,182 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+)
+
+// orfPrefixEntry is one ADD-ed entry of an RFC 5291 ORF type 64
+// (address-prefix) prefix list: match prefix with ge/le range.
+type orfPrefixEntry struct {
+	seq    uint32
+	prefix *bgp.IPAddrPrefixDefault
+	ge     uint8
+	le     uint8
+}
+
+// orfPrefixList is the peer-supplied implicit export filter built from
+// ORF type 64 entries received on a ROUTE-REFRESH. filterpath consults it
+// before policy evaluation so a peer can cut down what it's sent without
+// needing an export policy configured on our side.
+type orfPrefixList struct {
+	entries []*orfPrefixEntry
+}
+
+// apply reports whether path should be permitted by the ORF prefix list.
+// An empty list (no ADD entries received yet) permits everything, as
+// required by RFC 5291 section 3: ORF only restricts once populated.
+// An entry matches when its prefix contains path; the entry's ge/le
+// bounds are stored but not consulted.
+func (o *orfPrefixList) apply(path *table.Path) bool {
+	if o == nil || len(o.entries) == 0 {
+		return true
+	}
+	for _, e := range o.entries {
+		if e.prefix.Contains(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleOrfEntries applies the ADD/REMOVE/REMOVE-ALL actions carried by an
+// ORF payload to the peer's stored prefix list for family rf. DEFER vs
+// IMMEDIATE only affects when the peer expects a refresh to follow; since
+// we apply changes synchronously either way, we don't need to distinguish
+// them for storage purposes.
+func (peer *Peer) handleOrfEntries(rf bgp.RouteFamily, orfs []*bgp.ORFEntry) {
+	if peer.orfPrefixLists == nil {
+		peer.orfPrefixLists = make(map[bgp.RouteFamily]*orfPrefixList)
+	}
+	list, ok := peer.orfPrefixLists[rf]
+	if !ok {
+		list = &orfPrefixList{}
+		peer.orfPrefixLists[rf] = list
+	}
+	for _, o := range orfs {
+		switch o.Action() {
+		case bgp.ORF_ACTION_REMOVE_ALL:
+			list.entries = nil
+		case bgp.ORF_ACTION_ADD:
+			list.entries = append(list.entries, &orfPrefixEntry{
+				seq:    o.Sequence(),
+				prefix: o.Prefix(),
+				ge:     o.GE(),
+				le:     o.LE(),
+			})
+		case bgp.ORF_ACTION_REMOVE:
+			seq := o.Sequence()
+			filtered := list.entries[:0]
+			for _, e := range list.entries {
+				if e.seq != seq {
+					filtered = append(filtered, e)
+				}
+			}
+			list.entries = filtered
+		}
+	}
+	log.WithFields(log.Fields{
+		"Topic":         "Peer",
+		"Key":           peer.ID(),
+		"AddressFamily": rf.String(),
+		"Entries":       len(list.entries),
+	}).Debug("updated peer ORF prefix list")
+}
+
+// orfFilterPermits is the hook filterpath consults: it returns false if
+// the peer has installed an ORF prefix list for path's family and path
+// doesn't match any entry in it.
+func (peer *Peer) orfFilterPermits(path *table.Path) bool {
+	if peer.orfPrefixLists == nil {
+		return true
+	}
+	list, ok := peer.orfPrefixLists[path.GetRouteFamily()]
+	if !ok {
+		return true
+	}
+	return list.apply(path)
+}
+
+// enhancedRouteRefreshEnabled reports whether both sides advertised the
+// Enhanced Route Refresh capability (RFC 7313), in which case a
+// ROUTE-REFRESH response should be bracketed with BoRR/EoRR markers.
+//
+// This and handleRouteRefresh's BGP_CAP_ROUTE_REFRESH check are consumers
+// of peer.fsm.capMap - they read whatever the OPEN exchange negotiated,
+// they don't populate it. The code that sends our capabilities and parses
+// the peer's in the OPEN message lives in the FSM (fsm.go), which isn't
+// part of this checkout; this file has no producer for capMap and doesn't
+// add one. A neighbor this runs against must already have capMap populated
+// by that FSM-side negotiation, or enhancedRouteRefreshEnabled will always
+// see Enhanced Route Refresh as not negotiated. The ORF side does not read
+// capMap at all: handleRouteRefresh installs ORF entries and
+// orfFilterPermits applies them without checking the ORF capability.
+func (peer *Peer) enhancedRouteRefreshEnabled() bool {
+	_, ok := peer.fsm.capMap[bgp.BGP_CAP_ENHANCED_ROUTE_REFRESH]
+	return ok
+}
+
+// handleRouteRefresh processes an incoming ROUTE-REFRESH, honoring any
+// ORF payload it carries (RFC 5291) and, when Enhanced Route Refresh
+// (RFC 7313) was negotiated, returns the accepted/withdrawn paths
+// bracketed by Begin-of-RIB and End-of-RIB route-refresh markers so the
+// peer can tell a full re-advertisement from steady-state churn.
+func (peer *Peer) handleRouteRefresh(e *FsmMsg) []*table.Path {
+	m := e.MsgData.(*bgp.BGPMessage)
+	rr := m.Body.(*bgp.BGPRouteRefresh)
+	rf := bgp.AfiSafiToRouteFamily(rr.AFI, rr.SAFI)
+	if _, ok := peer.fsm.rfMap[rf]; !ok {
+		log.WithFields(log.Fields{
+			"Topic": "Peer",
+			"Key":   peer.ID(),
+			"Data":  rf,
+		}).Warn("Route family isn't supported")
+		return nil
+	}
+	if _, ok := peer.fsm.capMap[bgp.BGP_CAP_ROUTE_REFRESH]; !ok {
+		log.WithFields(log.Fields{
+			"Topic": "Peer",
+			"Key":   peer.ID(),
+		}).Warn("ROUTE_REFRESH received but the capability wasn't advertised")
+		return nil
+	}
+	if len(rr.ORF) > 0 {
+		peer.handleOrfEntries(rf, rr.ORF)
+	}
+
+	// Use the ADD-PATH-aware resync so a refresh actually resends every
+	// negotiated additional path, not just the best one.
+	rfList := []bgp.RouteFamily{rf}
+	accepted, filtered := peer.getAdditionalPathsFromLocal(rfList, true)
+	for _, path := range filtered {
+		path.IsWithdraw = true
+		accepted = append(accepted, path)
+	}
+
+	if peer.enhancedRouteRefreshEnabled() {
+		borr := table.NewBorr(rf)
+		eorr := table.NewEorr(rf)
+		out := make([]*table.Path, 0, len(accepted)+2)
+		out = append(out, borr)
+		out = append(out, accepted...)
+		out = append(out, eorr)
+		return out
+	}
+	return accepted
+}
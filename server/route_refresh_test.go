@@ -0,0 +1,40 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "testing"
+
+func TestOrfPrefixListApplyEmptyPermitsEverything(t *testing.T) {
+	var list *orfPrefixList
+	if !list.apply(nil) {
+		t.Errorf("nil orfPrefixList must permit everything")
+	}
+	list = &orfPrefixList{}
+	if !list.apply(nil) {
+		t.Errorf("empty orfPrefixList must permit everything, per RFC 5291 section 3")
+	}
+}
+
+// orfFilterPermits only touches peer.orfPrefixLists, so a zero-value Peer
+// (no fsm) is enough to exercise it; handleOrfEntries logs via peer.ID()
+// and needs a real fsm, which this tree has no type for (see the NOTE in
+// prefix_limit.go's ReadyToReestablish doc comment).
+func TestOrfFilterPermitsNoListConfigured(t *testing.T) {
+	peer := &Peer{}
+	if !peer.orfFilterPermits(nil) {
+		t.Errorf("a peer with no ORF prefix list configured must permit everything")
+	}
+}
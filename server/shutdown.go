@@ -0,0 +1,202 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+)
+
+// GRACEFUL_SHUTDOWN_MAX_REASON_LEN is the largest Shutdown Communication
+// TLV that draft-ietf-idr-shutdown / RFC 8203 allows: one length octet
+// followed by up to 128 bytes of UTF-8 text.
+const GRACEFUL_SHUTDOWN_MAX_REASON_LEN = 128
+
+// gracefulShutdownState tracks an in-progress administrative shutdown of a
+// single peer, from the moment GRACEFUL_SHUTDOWN communities start going
+// out until the drain timer fires and the Cease is sent.
+//
+// It's mutated from at least three goroutines: GracefulShutdown's caller,
+// the time.AfterFunc goroutine running finishGracefulShutdown, and the
+// filterpath/update-processing goroutine reading s.draining through
+// injectGracefulShutdownCommunity - the same cross-goroutine pattern
+// prefixLimitState guards with mu, so this does too.
+type gracefulShutdownState struct {
+	mu       sync.Mutex
+	reason   string
+	draining bool
+	timer    *time.Timer
+}
+
+// GracefulShutdown begins a graceful administrative shutdown of peer, as
+// described in RFC 8203 and draft-ietf-idr-shutdown: currently exported
+// best paths are re-advertised with the well-known GRACEFUL_SHUTDOWN
+// community so upstreams can lower LOCAL_PREF and steer traffic away,
+// then, once the drain timer configured on this neighbor elapses, a Cease
+// NOTIFICATION carrying reason as a Shutdown Communication TLV is sent and
+// the session is torn down.
+func (peer *Peer) GracefulShutdown(reason string) error {
+	if len(reason) > GRACEFUL_SHUTDOWN_MAX_REASON_LEN {
+		return fmt.Errorf("shutdown communication too long: %d > %d", len(reason), GRACEFUL_SHUTDOWN_MAX_REASON_LEN)
+	}
+	if peer.fsm.state != bgp.BGP_FSM_ESTABLISHED {
+		return fmt.Errorf("graceful shutdown requires an established session")
+	}
+
+	log.WithFields(log.Fields{
+		"Topic":  "Peer",
+		"Key":    peer.ID(),
+		"Reason": reason,
+	}).Info("starting graceful shutdown")
+
+	// A second call while a drain is already in progress must not leave
+	// the first timer running: if it fired after this call replaced
+	// peer.gracefulShutdown, finishGracefulShutdown would read the new
+	// state and send the Cease early, truncating the second drain window.
+	if s := peer.gracefulShutdown; s != nil {
+		s.mu.Lock()
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.mu.Unlock()
+	}
+
+	s := &gracefulShutdownState{reason: reason, draining: true}
+	peer.gracefulShutdown = s
+
+	rfList := peer.configuredRFlist()
+	pathList, _ := peer.getAdditionalPathsFromLocal(rfList, true)
+	sendFsmOutgoingMsg(peer, pathList, nil, false)
+
+	drain := peer.fsm.pConf.GracefulShutdown.Config.DrainTime
+	if drain == 0 {
+		drain = 10
+	}
+	timer := time.AfterFunc(time.Second*time.Duration(drain), peer.finishGracefulShutdown)
+	s.mu.Lock()
+	s.timer = timer
+	s.mu.Unlock()
+	return nil
+}
+
+// finishGracefulShutdown sends the Cease NOTIFICATION once the drain timer
+// configured for GracefulShutdown has elapsed.
+func (peer *Peer) finishGracefulShutdown() {
+	s := peer.gracefulShutdown
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.draining {
+		s.mu.Unlock()
+		return
+	}
+	s.draining = false
+	reason := s.reason
+	s.mu.Unlock()
+	msg := bgp.NewBGPNotificationMessage(bgp.BGP_ERROR_CEASE, bgp.BGP_ERROR_SUB_ADMINISTRATIVE_SHUTDOWN, encodeShutdownCommunication(reason))
+	sendFsmOutgoingMsg(peer, nil, msg, true)
+}
+
+// encodeShutdownCommunication builds the Cease NOTIFICATION Data field as
+// a Shutdown Communication TLV: a single length octet followed by the
+// UTF-8 reason text, per RFC 8203 section 2.
+func encodeShutdownCommunication(reason string) []byte {
+	if reason == "" {
+		return nil
+	}
+	return append([]byte{byte(len(reason))}, []byte(reason)...)
+}
+
+// decodeShutdownCommunication extracts the reason text from a Cease
+// NOTIFICATION Data field carrying a Shutdown Communication TLV. It
+// returns "" if data doesn't carry a well-formed TLV.
+func decodeShutdownCommunication(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+	n := int(data[0])
+	if n == 0 || len(data) < 1+n {
+		return ""
+	}
+	return string(data[1 : 1+n])
+}
+
+// injectGracefulShutdownCommunity prepends the well-known
+// GRACEFUL_SHUTDOWN community (0xFFFF0000) to path while a graceful
+// shutdown drain window is in progress for this peer, so downstream
+// routers can react to it per RFC 8326 / draft-ietf-idr-shutdown.
+func (peer *Peer) injectGracefulShutdownCommunity(path *table.Path) *table.Path {
+	if path == nil || path.IsWithdraw {
+		return path
+	}
+	s := peer.gracefulShutdown
+	if s == nil {
+		return path
+	}
+	s.mu.Lock()
+	draining := s.draining
+	s.mu.Unlock()
+	if !draining {
+		return path
+	}
+	path = path.Clone(false)
+	path.SetCommunities([]uint32{bgp.COMMUNITY_GRACEFUL_SHUTDOWN}, false)
+	return path
+}
+
+// handleShutdownNotification records a peer-initiated graceful shutdown
+// communication received in a Cease NOTIFICATION so it shows up in
+// ToConfig and the logs, per draft-ietf-idr-shutdown section 3.
+func (peer *Peer) handleShutdownNotification(body *bgp.BGPNotification) {
+	if body.ErrorCode != bgp.BGP_ERROR_CEASE || body.ErrorSubcode != bgp.BGP_ERROR_SUB_ADMINISTRATIVE_SHUTDOWN {
+		return
+	}
+	reason := decodeShutdownCommunication(body.Data)
+	if reason == "" {
+		return
+	}
+	peer.fsm.pConf.GracefulShutdown.State.Communication = reason
+	log.WithFields(log.Fields{
+		"Topic":  "Peer",
+		"Key":    peer.ID(),
+		"Reason": reason,
+	}).Info("peer is gracefully shutting down")
+}
+
+// handleNotification is the intended receive-side counterpart to
+// handleUpdate for incoming NOTIFICATION messages: it dispatches to
+// handleShutdownNotification so a peer-initiated Cease carrying a
+// Shutdown Communication TLV gets parsed and recorded instead of the
+// session just being torn down silently.
+//
+// It is not currently called anywhere: the FSM message-receive loop that
+// would own dispatching a parsed NOTIFICATION to per-type handlers
+// (fsm.go) isn't part of this tree. Until something calls this,
+// handleShutdownNotification never runs and GracefulShutdown.State.Communication
+// is never populated from a peer-initiated shutdown.
+func (peer *Peer) handleNotification(m *bgp.BGPMessage) {
+	body, ok := m.Body.(*bgp.BGPNotification)
+	if !ok {
+		return
+	}
+	peer.handleShutdownNotification(body)
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "testing"
+
+func TestEncodeDecodeShutdownCommunicationRoundTrip(t *testing.T) {
+	for _, reason := range []string{"a", "maintenance window", string(make([]byte, GRACEFUL_SHUTDOWN_MAX_REASON_LEN))} {
+		data := encodeShutdownCommunication(reason)
+		if got := decodeShutdownCommunication(data); got != reason {
+			t.Errorf("decodeShutdownCommunication(encodeShutdownCommunication(%q)) = %q", reason, got)
+		}
+	}
+}
+
+func TestEncodeShutdownCommunicationEmpty(t *testing.T) {
+	if data := encodeShutdownCommunication(""); data != nil {
+		t.Errorf("encodeShutdownCommunication(\"\") = %v, want nil", data)
+	}
+}
+
+func TestDecodeShutdownCommunicationMalformed(t *testing.T) {
+	cases := [][]byte{
+		nil,
+		{},
+		{0},
+		{5, 'h', 'i'}, // length byte claims more than is present
+	}
+	for _, data := range cases {
+		if got := decodeShutdownCommunication(data); got != "" {
+			t.Errorf("decodeShutdownCommunication(%v) = %q, want \"\"", data, got)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/osrg/gobgp/config"
+)
+
+// TCP_AO_ADD_KEY, TCP_AO_DEL_KEY, TCP_AO_SET_CURRENT and TCP_AO_GET_KEYS
+// are the sockopt names Linux 6.7 added for RFC 5925 TCP-AO
+// (Documentation/networking/tcp_ao.rst). They aren't exposed by syscall
+// yet, so we define them the same way package syscall does for newer
+// IPPROTO_TCP-level options.
+const (
+	tcpAOAddKey     = 0x24 // TCP_AO_ADD_KEY
+	tcpAODeleteKey  = 0x26 // TCP_AO_DEL_KEY
+	tcpAOSetCurrent = 0x25 // TCP_AO_SET_CURRENT
+	tcpAOInfo       = 0x23 // TCP_AO_GET_KEYS
+)
+
+// The layouts below mirror struct tcp_ao_add / struct tcp_ao_getsockopt
+// from include/uapi/linux/tcp.h as of the Linux 6.7 TCP-AO uAPI. They are
+// built by hand - encoding/binary over fixed-size byte buffers, not a Go
+// struct passed through unsafe.Pointer - specifically so the wire layout
+// doesn't depend on how the Go and C compilers would each pad an
+// equivalent struct. They have not been exercised against a live >=6.7
+// kernel in this environment (no such kernel is available here); treat
+// the offsets as "matches the documented uAPI", not "verified on the
+// wire", and confirm against CONFIG_TCP_AO before relying on this in
+// production.
+const (
+	sockaddrStorageLen = 128
+	algNameLen         = 64
+	tcpAOMaxKeyLen     = 80
+
+	// struct tcp_ao_add
+	aoAddAddrOff     = 0
+	aoAddAlgOff      = aoAddAddrOff + sockaddrStorageLen
+	aoAddIfindexOff  = aoAddAlgOff + algNameLen
+	aoAddKeyOff      = aoAddIfindexOff + 4
+	aoAddReservedOff = aoAddKeyOff + tcpAOMaxKeyLen // uint16
+	aoAddFlagsOff    = aoAddReservedOff + 2         // uint8: set_current/set_rnext bits
+	aoAddPrefixOff   = aoAddFlagsOff + 1
+	aoAddSndIDOff    = aoAddPrefixOff + 1
+	aoAddRcvIDOff    = aoAddSndIDOff + 1
+	aoAddMacLenOff   = aoAddRcvIDOff + 1
+	aoAddKeyFlagsOff = aoAddMacLenOff + 1
+	aoAddKeyLenOff   = aoAddKeyFlagsOff + 1
+	sizeofTCPAOAdd   = (aoAddKeyLenOff + 1 + 3) &^ 3 // round up to the 4-byte alignment the ifindex field forces
+
+	aoAddSetCurrentBit = 1 << 0
+
+	// struct tcp_ao_getsockopt
+	aoGetAddrOff        = 0
+	aoGetAlgOff         = aoGetAddrOff + sockaddrStorageLen
+	aoGetKeyOff         = aoGetAlgOff + algNameLen
+	aoGetKeyFlagsOff    = aoGetKeyOff + tcpAOMaxKeyLen // uint32
+	aoGetSneOff         = aoGetKeyFlagsOff + 4         // uint32
+	aoGetPacketCountOff = (aoGetSneOff + 4 + 7) &^ 7   // uint64, 8-byte aligned
+	aoGetByteCountOff   = aoGetPacketCountOff + 8
+	aoGetIfindexOff     = aoGetByteCountOff + 8 // int32
+	aoGetReservedOff    = aoGetIfindexOff + 4   // uint16
+	aoGetReserved2Off   = aoGetReservedOff + 2  // uint8
+	aoGetPrefixOff      = aoGetReserved2Off + 1
+	aoGetSndIDOff       = aoGetPrefixOff + 1
+	aoGetRcvIDOff       = aoGetSndIDOff + 1
+	aoGetNKeysOff       = aoGetRcvIDOff + 1
+	aoGetFlagsOff       = aoGetNKeysOff + 1 // uint8: match_all/is_current/is_rnext/get_all bits
+	aoGetMacLenOff      = aoGetFlagsOff + 1
+	aoGetKeyLenOff      = aoGetMacLenOff + 1
+	sizeofTCPAOGet      = (aoGetKeyLenOff + 1 + 7) &^ 7 // round up to 8-byte alignment (packet_count/byte_count are u64)
+
+	aoGetIsCurrentBit = 1 << 1
+)
+
+func algoToKernel(algo config.TcpAoAlgorithm) (string, uint8, error) {
+	switch algo {
+	case config.TCP_AO_ALGORITHM_HMAC_SHA_1_96:
+		return "hmac(sha1)", 12, nil
+	case config.TCP_AO_ALGORITHM_AES_128_CMAC_96:
+		return "cmac(aes128)", 12, nil
+	default:
+		return "", 0, fmt.Errorf("unsupported TCP-AO algorithm: %v", algo)
+	}
+}
+
+// sockaddrStorageBytes overlays the address-family-specific sockaddr at
+// the front of a sockaddr_storage, which is all the kernel inspects here.
+func sockaddrStorageBytes(addr *net.TCPAddr) [sockaddrStorageLen]byte {
+	var buf [sockaddrStorageLen]byte
+	if addr == nil {
+		return buf
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		binary.LittleEndian.PutUint16(buf[0:2], uint16(syscall.AF_INET))
+		binary.BigEndian.PutUint16(buf[2:4], uint16(addr.Port))
+		copy(buf[4:8], ip4)
+		return buf
+	}
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(syscall.AF_INET6))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(addr.Port))
+	copy(buf[8:24], addr.IP.To16())
+	return buf
+}
+
+// marshalTCPAOAdd builds the tcp_ao_add request for TCP_AO_ADD_KEY: peer
+// address, algorithm name, raw key material and the send/recv key-ids.
+func marshalTCPAOAdd(peerAddr *net.TCPAddr, sendKeyID, recvKeyID uint8, algo string, macLen uint8, key []byte) ([]byte, error) {
+	if len(key) > tcpAOMaxKeyLen {
+		return nil, fmt.Errorf("TCP-AO key is %d bytes, exceeds kernel max of %d", len(key), tcpAOMaxKeyLen)
+	}
+	if len(algo) >= algNameLen {
+		return nil, fmt.Errorf("TCP-AO algorithm name %q doesn't fit in %d bytes", algo, algNameLen)
+	}
+
+	buf := make([]byte, sizeofTCPAOAdd)
+	addr := sockaddrStorageBytes(peerAddr)
+	copy(buf[aoAddAddrOff:aoAddAddrOff+sockaddrStorageLen], addr[:])
+	copy(buf[aoAddAlgOff:aoAddAlgOff+algNameLen], algo)
+	binary.LittleEndian.PutUint32(buf[aoAddIfindexOff:], 0)
+	copy(buf[aoAddKeyOff:aoAddKeyOff+tcpAOMaxKeyLen], key)
+	buf[aoAddFlagsOff] = 0
+	buf[aoAddPrefixOff] = 0
+	buf[aoAddSndIDOff] = sendKeyID
+	buf[aoAddRcvIDOff] = recvKeyID
+	buf[aoAddMacLenOff] = macLen
+	buf[aoAddKeyFlagsOff] = 0
+	buf[aoAddKeyLenOff] = uint8(len(key))
+	return buf, nil
+}
+
+// marshalTCPAOGetByRecvID builds a tcp_ao_getsockopt request for the MKT
+// entry whose rcv_id is recvKeyID - an exact lookup by key-id (neither the
+// is_current nor is_rnext selector bit set), not "whichever key is
+// currently marked current for sending". The entry's rcv_id is the key-id
+// we expect the PEER's outbound AO KeyID to carry, which is what
+// platformTCPAOKeyVerified needs to confirm the accepted connection
+// actually used.
+func marshalTCPAOGetByRecvID(recvKeyID uint8) []byte {
+	buf := make([]byte, sizeofTCPAOGet)
+	buf[aoGetNKeysOff] = 1
+	buf[aoGetRcvIDOff] = recvKeyID
+	return buf
+}
+
+// unmarshalTCPAOGetPacketCount reads back tcp_ao_getsockopt's pkt_good
+// counter: the number of inbound segments on this connection the kernel
+// has actually verified against the queried key. A non-zero count is real
+// evidence the peer used this key, unlike comparing key-ids alone, which
+// only confirms the ids match without saying whether the kernel ever
+// authenticated anything with them.
+func unmarshalTCPAOGetPacketCount(buf []byte) (uint64, error) {
+	if len(buf) < aoGetPacketCountOff+8 {
+		return 0, fmt.Errorf("TCP_AO_GET_KEYS returned a short result (%d bytes)", len(buf))
+	}
+	return binary.LittleEndian.Uint64(buf[aoGetPacketCountOff : aoGetPacketCountOff+8]), nil
+}
+
+func platformInstallTCPAOKeys(conn *net.TCPConn, conf config.TcpAo) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	peerAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		opErr = platformInstallTCPAOKeysFd(fd, peerAddr, conf)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+// platformInstallTCPAOKeysFd is the fd-level entry point so the active
+// side can install keys via net.Dialer.Control - which hands back a raw
+// fd before connect() is called - instead of only being reachable after
+// a *net.TCPConn already exists post-connect, which would be too late for
+// the kernel to sign the initial SYN.
+func platformInstallTCPAOKeysFd(fd uintptr, peerAddr *net.TCPAddr, conf config.TcpAo) error {
+	found := false
+	for _, mkt := range conf.Mkt {
+		if err := platformAddTCPAOKeyFd(fd, peerAddr, mkt); err != nil {
+			return err
+		}
+		if mkt.Config.SendKeyId == conf.Config.KeyId {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("TCP-AO key-id %d is not present among the configured master key tuples", conf.Config.KeyId)
+	}
+	return platformSetCurrentTCPAOKeyFd(fd, conf.Config.KeyId)
+}
+
+func platformAddTCPAOKey(conn *net.TCPConn, mkt config.TcpAoMkt) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	peerAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		opErr = platformAddTCPAOKeyFd(fd, peerAddr, mkt)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+func platformAddTCPAOKeyFd(fd uintptr, peerAddr *net.TCPAddr, mkt config.TcpAoMkt) error {
+	algo, macLen, err := algoToKernel(mkt.Config.Algorithm)
+	if err != nil {
+		return err
+	}
+	req, err := marshalTCPAOAdd(peerAddr, mkt.Config.SendKeyId, mkt.Config.RecvKeyId, algo, macLen, []byte(mkt.Config.Key))
+	if err != nil {
+		return err
+	}
+	return setsockoptBytes(int(fd), syscall.IPPROTO_TCP, tcpAOAddKey, req)
+}
+
+func platformDeleteTCPAOKey(conn *net.TCPConn, sendKeyID uint8) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptByte(int(fd), syscall.IPPROTO_TCP, tcpAODeleteKey, sendKeyID)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+func platformSetCurrentTCPAOKey(conn *net.TCPConn, sendKeyID uint8) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		opErr = platformSetCurrentTCPAOKeyFd(fd, sendKeyID)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+func platformSetCurrentTCPAOKeyFd(fd uintptr, sendKeyID uint8) error {
+	return syscall.SetsockoptByte(int(fd), syscall.IPPROTO_TCP, tcpAOSetCurrent, sendKeyID)
+}
+
+// platformTCPAOKeyVerified reports whether the kernel has verified at
+// least one inbound segment on conn against the MKT entry whose rcv_id is
+// recvKeyID. This is what validateTCPAOKeyID actually needs: confirming
+// that conn's accepted handshake was authenticated with the key this
+// neighbor is configured to expect from the peer, not merely that our own
+// "current" (send-side) key's rcv_id happens to equal our own config -
+// which is true by construction (we set both ids together in
+// platformAddTCPAOKeyFd) and says nothing about what the peer sent.
+func platformTCPAOKeyVerified(conn *net.TCPConn, recvKeyID uint8) (bool, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	req := marshalTCPAOGetByRecvID(recvKeyID)
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		opErr = getsockoptBytes(int(fd), syscall.IPPROTO_TCP, tcpAOInfo, req)
+	})
+	if err != nil {
+		return false, err
+	}
+	if opErr != nil {
+		return false, opErr
+	}
+	count, err := unmarshalTCPAOGetPacketCount(req)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// setsockoptBytes/getsockoptBytes issue a raw setsockopt(2)/getsockopt(2)
+// with an arbitrary-length struct buffer, which the syscall package
+// doesn't expose a helper for beyond fixed types like byte/int/IPMreq.
+func setsockoptBytes(fd, level, opt int, buf []byte) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getsockoptBytes(fd, level, opt int, buf []byte) error {
+	l := uint32(len(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&l)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/osrg/gobgp/config"
+)
+
+func TestMarshalTCPAOAdd(t *testing.T) {
+	peerAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 179}
+	key := []byte("supersecretkey")
+	buf, err := marshalTCPAOAdd(peerAddr, 1, 2, "hmac(sha1)", 12, key)
+	if err != nil {
+		t.Fatalf("marshalTCPAOAdd() error = %v", err)
+	}
+	if len(buf) != sizeofTCPAOAdd {
+		t.Fatalf("len(buf) = %d, want %d", len(buf), sizeofTCPAOAdd)
+	}
+	if got := buf[aoAddSndIDOff]; got != 1 {
+		t.Errorf("snd_id = %d, want 1", got)
+	}
+	if got := buf[aoAddRcvIDOff]; got != 2 {
+		t.Errorf("rcv_id = %d, want 2", got)
+	}
+	if got := buf[aoAddMacLenOff]; got != 12 {
+		t.Errorf("maclen = %d, want 12", got)
+	}
+	if got := buf[aoAddKeyLenOff]; int(got) != len(key) {
+		t.Errorf("keylen = %d, want %d", got, len(key))
+	}
+	if got := string(buf[aoAddKeyOff : aoAddKeyOff+len(key)]); got != string(key) {
+		t.Errorf("key bytes = %q, want %q", got, key)
+	}
+}
+
+func TestMarshalTCPAOAddKeyTooLong(t *testing.T) {
+	key := make([]byte, tcpAOMaxKeyLen+1)
+	if _, err := marshalTCPAOAdd(nil, 1, 2, "hmac(sha1)", 12, key); err == nil {
+		t.Errorf("expected an error for a key longer than %d bytes", tcpAOMaxKeyLen)
+	}
+}
+
+func TestMarshalTCPAOAddAlgNameTooLong(t *testing.T) {
+	algo := make([]byte, algNameLen)
+	if _, err := marshalTCPAOAdd(nil, 1, 2, string(algo), 12, nil); err == nil {
+		t.Errorf("expected an error for an algorithm name that doesn't fit in %d bytes", algNameLen)
+	}
+}
+
+func TestMarshalTCPAOGetByRecvID(t *testing.T) {
+	buf := marshalTCPAOGetByRecvID(7)
+	if len(buf) != sizeofTCPAOGet {
+		t.Fatalf("len(buf) = %d, want %d", len(buf), sizeofTCPAOGet)
+	}
+	if got := buf[aoGetNKeysOff]; got != 1 {
+		t.Errorf("nkeys = %d, want 1", got)
+	}
+	if got := buf[aoGetRcvIDOff]; got != 7 {
+		t.Errorf("rcv_id = %d, want 7", got)
+	}
+	if got := buf[aoGetFlagsOff]; got != 0 {
+		t.Errorf("flags = %d, want 0 (exact lookup by id, not is_current/is_rnext/get_all)", got)
+	}
+}
+
+func TestUnmarshalTCPAOGetPacketCount(t *testing.T) {
+	buf := make([]byte, sizeofTCPAOGet)
+	binary.LittleEndian.PutUint64(buf[aoGetPacketCountOff:aoGetPacketCountOff+8], 42)
+	count, err := unmarshalTCPAOGetPacketCount(buf)
+	if err != nil {
+		t.Fatalf("unmarshalTCPAOGetPacketCount() error = %v", err)
+	}
+	if count != 42 {
+		t.Errorf("count = %d, want 42", count)
+	}
+}
+
+func TestUnmarshalTCPAOGetPacketCountShortBuffer(t *testing.T) {
+	if _, err := unmarshalTCPAOGetPacketCount(make([]byte, 4)); err == nil {
+		t.Errorf("expected an error for a buffer shorter than the packet-count field")
+	}
+}
+
+func TestAlgoToKernel(t *testing.T) {
+	for _, algo := range []config.TcpAoAlgorithm{
+		config.TCP_AO_ALGORITHM_HMAC_SHA_1_96,
+		config.TCP_AO_ALGORITHM_AES_128_CMAC_96,
+	} {
+		if _, macLen, err := algoToKernel(algo); err != nil || macLen != 12 {
+			t.Errorf("algoToKernel(%v) = (_, %d, %v), want (_, 12, nil)", algo, macLen, err)
+		}
+	}
+	if _, _, err := algoToKernel(config.TcpAoAlgorithm("bogus")); err == nil {
+		t.Errorf("expected an error for an unsupported algorithm")
+	}
+}
+
+func TestSockaddrStorageBytesIPv4(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 179}
+	buf := sockaddrStorageBytes(addr)
+	if got := binary.BigEndian.Uint16(buf[2:4]); got != 179 {
+		t.Errorf("port = %d, want 179", got)
+	}
+	if got := net.IP(buf[4:8]); !got.Equal(addr.IP) {
+		t.Errorf("address = %v, want %v", got, addr.IP)
+	}
+}
+
+func TestSockaddrStorageBytesNil(t *testing.T) {
+	var zero [sockaddrStorageLen]byte
+	if got := sockaddrStorageBytes(nil); got != zero {
+		t.Errorf("sockaddrStorageBytes(nil) = %v, want all-zero", got)
+	}
+}
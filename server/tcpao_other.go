@@ -0,0 +1,57 @@
+// Copyright (C) 2016-2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/osrg/gobgp/config"
+)
+
+// TCP-AO (RFC 5925) needs TCP_AO_ADD_KEY/TCP_AO_SET_CURRENT, which only
+// Linux >= 6.7 exposes. On every other platform we fail the config
+// explicitly instead of silently falling back to TCP-MD5, per the
+// request: operators need to know their configured auth method isn't
+// actually in effect.
+var errTCPAOUnsupported = fmt.Errorf("TCP-AO is not supported on this platform")
+
+func platformInstallTCPAOKeys(conn *net.TCPConn, conf config.TcpAo) error {
+	return errTCPAOUnsupported
+}
+
+func platformInstallTCPAOKeysFd(fd uintptr, peerAddr *net.TCPAddr, conf config.TcpAo) error {
+	return errTCPAOUnsupported
+}
+
+func platformAddTCPAOKey(conn *net.TCPConn, mkt config.TcpAoMkt) error {
+	return errTCPAOUnsupported
+}
+
+func platformSetCurrentTCPAOKey(conn *net.TCPConn, sendKeyID uint8) error {
+	return errTCPAOUnsupported
+}
+
+func platformDeleteTCPAOKey(conn *net.TCPConn, sendKeyID uint8) error {
+	return errTCPAOUnsupported
+}
+
+func platformTCPAOKeyVerified(conn *net.TCPConn, recvKeyID uint8) (bool, error) {
+	return false, errTCPAOUnsupported
+}